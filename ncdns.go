@@ -9,6 +9,15 @@ import "strings"
 import "sort"
 import "github.com/hlandau/degoutils/config"
 import "github.com/hlandau/ncdns/ncerr"
+import "container/list"
+import "crypto/sha256"
+import "encoding/hex"
+import "time"
+import "net"
+import "sync"
+import "net/http"
+import "github.com/prometheus/client_golang/prometheus"
+import "github.com/prometheus/client_golang/prometheus/promhttp"
 
 // A Go daemon to serve Namecoin domain records via DNS.
 // This daemon is intended to be used in one of the following situations:
@@ -44,6 +53,7 @@ func main() {
 func NewServer(cfg *ServerConfig) *Server {
   s := &Server{}
   s.cfg = *cfg
+  s.sigCache = newSigCache(cfg.SignatureCacheMaxEntries)
   return s
 }
 
@@ -107,6 +117,7 @@ func (s *Server) Run() {
   // run
   s.udpListener = s.runListener("udp")
   s.tcpListener = s.runListener("tcp")
+  s.runMetrics()
 
   log.Info("Ready.")
 
@@ -130,6 +141,7 @@ type Server struct {
   zskPrivate dns.PrivateKey
   cfg ServerConfig
   b Backend
+  sigCache *sigCache
 }
 
 type ServerConfig struct {
@@ -143,6 +155,10 @@ type ServerConfig struct {
   NamecoinRPCPassword string `default:"" usage:"Namecoin RPC password"`
   NamecoinRPCAddress  string `default:"localhost:8336" usage:"Namecoin RPC server address"`
   CacheMaxEntries     int    `default:"1000" usage:"Maximum name cache entries"`
+  SignatureCacheMaxEntries int `default:"4096" usage:"Maximum RRSIG cache entries"`
+  EDNSUDPSize         uint16 `default:"4096" usage:"EDNS0 UDP payload size to advertise to clients"`
+  UDPAnswerLimit      int    `default:"8" usage:"Maximum number of A/AAAA records returned per RRset over UDP"`
+  MetricsBind         string `default:"" usage:"Address to serve Prometheus metrics on (e.g. 127.0.0.1:9101); disabled if empty"`
   SelfIP              string `default:"127.127.127.127" usage:"The canonical IP address for this service"`
   SelfName            string `default:"" usage:"Canonical name for this nameserver (default: autogenerated psuedo-hostname resolving to SelfIP; SelfIP is not used if this is set)"`
 }
@@ -162,6 +178,102 @@ func (s *Server) runListener(net string) *dns.Server {
   return ds
 }
 
+var (
+  metricQueriesTotal = prometheus.NewCounter(prometheus.CounterOpts{
+    Namespace: "ncdns",
+    Name: "queries_total",
+    Help: "Total number of DNS queries received.",
+  })
+  metricQueriesByType = prometheus.NewCounterVec(prometheus.CounterOpts{
+    Namespace: "ncdns",
+    Name: "queries_by_qtype_total",
+    Help: "DNS queries received, by query type.",
+  }, []string{"qtype"})
+  metricResponsesByRcode = prometheus.NewCounterVec(prometheus.CounterOpts{
+    Namespace: "ncdns",
+    Name: "responses_by_rcode_total",
+    Help: "DNS responses sent, by response code.",
+  }, []string{"rcode"})
+  metricErrorsByClass = prometheus.NewCounterVec(prometheus.CounterOpts{
+    Namespace: "ncdns",
+    Name: "errors_by_class_total",
+    Help: "Handler errors, by error class.",
+  }, []string{"class"})
+  metricBackendLookupDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+    Namespace: "ncdns",
+    Name: "backend_lookup_duration_seconds",
+    Help: "Time taken for Namecoin backend lookups.",
+    Buckets: prometheus.DefBuckets,
+  })
+  metricSignDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+    Namespace: "ncdns",
+    Name: "rrsig_sign_duration_seconds",
+    Help: "Time taken to produce a single RRSIG, on signature cache misses.",
+    Buckets: prometheus.DefBuckets,
+  })
+  metricResponseDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+    Namespace: "ncdns",
+    Name: "response_duration_seconds",
+    Help: "End-to-end time taken to answer a query.",
+    Buckets: prometheus.DefBuckets,
+  })
+  metricBackendCacheSize = prometheus.NewGauge(prometheus.GaugeOpts{
+    Namespace: "ncdns",
+    Name: "backend_cache_entries",
+    Help: "Current number of entries in the backend name cache.",
+  })
+  metricSigCacheSize = prometheus.NewGauge(prometheus.GaugeOpts{
+    Namespace: "ncdns",
+    Name: "signature_cache_entries",
+    Help: "Current number of entries in the RRSIG cache.",
+  })
+  metricSigCacheHitRatio = prometheus.NewGauge(prometheus.GaugeOpts{
+    Namespace: "ncdns",
+    Name: "signature_cache_hit_ratio",
+    Help: "Hit ratio of the RRSIG cache since startup.",
+  })
+)
+
+func init() {
+  prometheus.MustRegister(metricQueriesTotal, metricQueriesByType, metricResponsesByRcode,
+    metricErrorsByClass, metricBackendLookupDuration, metricSignDuration, metricResponseDuration,
+    metricBackendCacheSize, metricSigCacheSize, metricSigCacheHitRatio)
+}
+
+// cacheSizer is implemented by backends that can report how many entries
+// they currently hold, so we can expose it as a gauge.
+type cacheSizer interface {
+  CacheSize() int
+}
+
+// runMetrics starts the Prometheus metrics HTTP endpoint if
+// cfg.MetricsBind is set, and a background poller for the gauges that
+// aren't updated inline as part of request handling.
+func (s *Server) runMetrics() {
+  if s.cfg.MetricsBind == "" {
+    return
+  }
+
+  mux := http.NewServeMux()
+  mux.Handle("/metrics", promhttp.Handler())
+  go func() {
+    err := http.ListenAndServe(s.cfg.MetricsBind, mux)
+    log.Fatale(err, "metrics server failed")
+  }()
+
+  go s.pollGauges()
+}
+
+func (s *Server) pollGauges() {
+  for range time.Tick(10 * time.Second) {
+    if cs, ok := s.b.(cacheSizer); ok {
+      metricBackendCacheSize.Set(float64(cs.CacheSize()))
+    }
+    metricSigCacheSize.Set(float64(s.sigCache.Len()))
+    metricSigCacheHitRatio.Set(s.sigCache.HitRatio())
+  }
+}
+
 type Tx struct {
   req *dns.Msg
   res *dns.Msg
@@ -171,6 +283,11 @@ type Tx struct {
   s      *Server
   rcode  int
 
+  // Whether this query arrived over UDP. UDPAnswerLimit only applies
+  // when this is set -- TCP has no small-packet size constraint to
+  // protect, so trimming RRsets there would just lose data for nothing.
+  isUDP bool
+
   typesAtQname map[uint16]struct{}
   additionalQueue map[string]struct{}
   soa *dns.SOA
@@ -191,9 +308,20 @@ type Tx struct {
 
   // Don't NSEC for having no answers. Used for qtype==DS.
   suppressNSEC bool
+
+  // Set when the queried name genuinely doesn't exist (NXDOMAIN). We
+  // don't return this from addAnswersAuthoritative/addAnswersMain
+  // straight away: the rest of addAnswers still needs to run so the
+  // NSEC3 denial-of-existence proof and signing happen, and only once
+  // that's done does addAnswers hand the error back up so s.handle can
+  // set RcodeNameError.
+  nxdomain bool
 }
 
 func (s *Server) handle(rw dns.ResponseWriter, reqMsg *dns.Msg) {
+  startTime := time.Now()
+  metricQueriesTotal.Inc()
+
   tx := Tx{}
   tx.req = reqMsg
   tx.res = &dns.Msg{}
@@ -205,9 +333,22 @@ func (s *Server) handle(rw dns.ResponseWriter, reqMsg *dns.Msg) {
   tx.typesAtQname = map[uint16]struct{}{}
   tx.additionalQueue = map[string]struct{}{}
 
+  _, isTCP := rw.RemoteAddr().(*net.TCPAddr)
+  tx.isUDP = !isTCP
+
+  requesterUDPSize := uint16(512)
   opt := tx.req.IsEdns0()
   if opt != nil {
-    tx.res.Extra = append(tx.res.Extra, opt)
+    if sz := opt.UDPSize(); sz > requesterUDPSize {
+      requesterUDPSize = sz
+    }
+
+    respOpt := &dns.OPT{}
+    respOpt.Hdr.Name = "."
+    respOpt.Hdr.Rrtype = dns.TypeOPT
+    respOpt.SetUDPSize(s.cfg.EDNSUDPSize)
+    respOpt.SetDo(opt.Do())
+    tx.res.Extra = append(tx.res.Extra, respOpt)
   }
 
   for _, q := range tx.req.Question {
@@ -219,15 +360,20 @@ func (s *Server) handle(rw dns.ResponseWriter, reqMsg *dns.Msg) {
       continue
     }
 
+    metricQueriesByType.WithLabelValues(dns.TypeToString[tx.qtype]).Inc()
+
     err := tx.addAnswers()
     if err != nil {
       if err == ncerr.ErrNoResults {
         tx.rcode = 0
+        metricErrorsByClass.WithLabelValues("no_results").Inc()
       } else if err == ncerr.ErrNoSuchDomain {
         tx.rcode = dns.RcodeNameError
+        metricErrorsByClass.WithLabelValues("no_such_domain").Inc()
       } else if tx.rcode == 0 {
         log.Infoe(err, "Handler error, doing SERVFAIL")
         tx.rcode = dns.RcodeServerFailure
+        metricErrorsByClass.WithLabelValues("other").Inc()
       }
       break
     }
@@ -235,15 +381,79 @@ func (s *Server) handle(rw dns.ResponseWriter, reqMsg *dns.Msg) {
   }
 
   tx.res.SetRcode(tx.req, tx.rcode)
+  metricResponsesByRcode.WithLabelValues(dns.RcodeToString[tx.rcode]).Inc()
+
+  if tx.isUDP {
+    tx.capUDPResponse(requesterUDPSize)
+  }
 
   //log.Info("response: ", res.String())
   err := rw.WriteMsg(tx.res)
   log.Infoe(err, "Couldn't write response: " + tx.res.String())
+
+  elapsed := time.Since(startTime)
+  metricResponseDuration.Observe(elapsed.Seconds())
+  log.Info("query ", tx.qname, " ", dns.TypeToString[tx.qtype], " -> ", dns.RcodeToString[tx.rcode],
+    " (", len(tx.res.Answer), " answers) in ", elapsed)
+}
+
+// capUDPResponse makes sure the response fits within limit bytes, as
+// advertised by the requester's EDNS0 UDP size (or 512 if it didn't send
+// one). RRSIG + NSEC3 + delegation glue routinely exceed 512 bytes, so
+// we progressively drop the least essential data -- Extra glue first,
+// then Authority NSEC3s, then the Answer itself. TC is set only when the
+// Answer has to be dropped, so the client knows to retry over TCP. A
+// truncated response must still actually fit in limit bytes; shipping a
+// "truncated" packet that's still oversized just gets it dropped or
+// fragmented instead of letting the client fall back cleanly.
+func (tx *Tx) capUDPResponse(limit uint16) {
+  if tx.res.Len() <= int(limit) {
+    return
+  }
+
+  var keptExtra []dns.RR
+  for _, rr := range tx.res.Extra {
+    if rr.Header().Rrtype == dns.TypeOPT {
+      keptExtra = append(keptExtra, rr)
+    }
+  }
+  tx.res.Extra = keptExtra
+
+  if tx.res.Len() <= int(limit) {
+    return
+  }
+
+  var keptNs []dns.RR
+  for _, rr := range tx.res.Ns {
+    if rr.Header().Rrtype == dns.TypeNSEC3 {
+      continue
+    }
+    // Drop the NSEC3's RRSIG alongside it too -- for RSA it's typically
+    // as large as the NSEC3 itself, so leaving it behind as an orphaned
+    // signature would undo most of the space we just reclaimed.
+    if sig, ok := rr.(*dns.RRSIG); ok && sig.TypeCovered == dns.TypeNSEC3 {
+      continue
+    }
+    keptNs = append(keptNs, rr)
+  }
+  tx.res.Ns = keptNs
+
+  if tx.res.Len() <= int(limit) {
+    return
+  }
+
+  // Still too big even with both Extra and the NSEC3 proof dropped:
+  // empty the Answer section too so the packet we actually send is
+  // small, rather than setting TC on an oversized message.
+  tx.res.Answer = nil
+  tx.res.Truncated = true
 }
 
 func (tx *Tx) blookup(qname string) (rrs []dns.RR, err error) {
   log.Info("blookup: ", qname)
+  startTime := time.Now()
   rrs, err = tx.s.b.Lookup(qname)
+  metricBackendLookupDuration.Observe(time.Since(startTime).Seconds())
   if err == nil && len(rrs) == 0 {
     err = ncerr.ErrNoResults
   }
@@ -281,6 +491,16 @@ func (tx *Tx) addAnswers() error {
     }
 
     tx.typesAtQname[dns.TypeDNSKEY] = struct{}{}
+
+    // SOA and NS queries at the apex need the zone's nameservers (plus
+    // their glue) added so recursive resolvers get everything RFC 1035
+    // expects from an apex answer, not just the bare record.
+    if tx.qtype == dns.TypeSOA || tx.qtype == dns.TypeNS {
+      err := tx.addApexAuthority()
+      if err != nil {
+        return err
+      }
+    }
   }
 
   //
@@ -303,6 +523,13 @@ func (tx *Tx) addAnswers() error {
     return err
   }
 
+  if tx.nxdomain {
+    // Everything needed for the response body (NSEC3 proof, glue,
+    // signatures) is already attached to tx.res; now let the caller
+    // know the name didn't actually exist so it can set RcodeNameError.
+    return ncerr.ErrNoSuchDomain
+  }
+
   return nil
 }
 
@@ -418,7 +645,17 @@ func (tx *Tx) addAnswersAuthoritative(rrs []dns.RR, origerr error) error {
   //
   //     - Any other record
   if origerr != nil {
-    return origerr
+    if origerr != ncerr.ErrNoSuchDomain {
+      return origerr
+    }
+
+    // NXDOMAIN: defer returning the error to addAnswers, which needs to
+    // run addNSEC/addAdditional/signResponse first so the NSEC3
+    // denial-of-existence proof (built in chunk0-3) actually gets
+    // attached to the response instead of being unreachable.
+    tx.nxdomain = true
+    tx.consolationSOA = true
+    return nil
   }
 
   cn := rrsetHasType(rrs, dns.TypeCNAME)
@@ -428,11 +665,28 @@ func (tx *Tx) addAnswersAuthoritative(rrs []dns.RR, origerr error) error {
     return tx.addAnswersCNAME(cn.(*dns.CNAME))
   }
 
-  // Add every record which was requested.
+  // Add every record which was requested. Over UDP, cap how many A/AAAA
+  // records we hand back per RRset so large record sets don't blow past
+  // what fits in a UDP response; TCP has no such size constraint, so the
+  // limit only applies when tx.isUDP.
+  aCount, aaaaCount := 0, 0
   for i := range rrs {
     t := rrs[i].Header().Rrtype
     if tx.istype(t) {
-      tx.res.Answer = append(tx.res.Answer, rrs[i])
+      switch {
+      case tx.isUDP && t == dns.TypeA:
+        aCount++
+        if aCount <= tx.s.cfg.UDPAnswerLimit {
+          tx.res.Answer = append(tx.res.Answer, rrs[i])
+        }
+      case tx.isUDP && t == dns.TypeAAAA:
+        aaaaCount++
+        if aaaaCount <= tx.s.cfg.UDPAnswerLimit {
+          tx.res.Answer = append(tx.res.Answer, rrs[i])
+        }
+      default:
+        tx.res.Answer = append(tx.res.Answer, rrs[i])
+      }
     }
 
     // Keep track of the types that really do exist here in case we have to NSEC.
@@ -506,6 +760,76 @@ func (tx *Tx) queueAdditional(name string) {
   tx.additionalQueue[name] = struct{}{}
 }
 
+// nameservers returns the NS records found at apex, the zone's own apex
+// name. It's a thin wrapper over the backend lookup tx already does for
+// everything else; addApexAuthority is its only caller.
+func (s *Server) nameservers(tx *Tx, apex string) ([]dns.RR, error) {
+  rrs, err := tx.blookup(apex)
+  if err != nil {
+    return nil, err
+  }
+
+  var nss []dns.RR
+  for _, rr := range rrs {
+    if rr.Header().Rrtype == dns.TypeNS {
+      nss = append(nss, rr)
+    }
+  }
+
+  return nss, nil
+}
+
+// addApexAuthority adds the zone's NS records to the Authority section
+// (for a direct SOA query; a direct NS query already got them in the
+// Answer section via the usual addAnswersAuthoritative loop) and queues
+// A/AAAA glue for each in Extra. For qtype == SOA it also synthesizes a
+// CNAME pointing the SOA's MNAME at SelfName when MNAME and SelfName are
+// both set and MNAME isn't one of the zone's own nameservers, since in
+// that case it wouldn't otherwise get
+// glue and would be left unresolvable in the response.
+func (tx *Tx) addApexAuthority() error {
+  nss, err := tx.s.nameservers(tx, tx.soa.Hdr.Name)
+  if err != nil {
+    // No NS records to add; not fatal to the SOA/NS answer itself.
+    return nil
+  }
+
+  haveMname := false
+  for _, ns := range nss {
+    ns_ := ns.(*dns.NS)
+
+    if tx.qtype == dns.TypeSOA {
+      tx.res.Ns = append(tx.res.Ns, ns)
+    }
+
+    // ns_.Ns is this nameserver's own name; tx.soa.Ns is the MNAME field
+    // of the SOA (dns.SOA names it Ns too, but it means something
+    // different there) -- we're checking whether the MNAME is one of
+    // the zone's own nameservers and so already got glue above.
+    tx.queueAdditional(ns_.Ns)
+
+    if strings.EqualFold(ns_.Ns, tx.soa.Ns) {
+      haveMname = true
+    }
+  }
+
+  if tx.qtype == dns.TypeSOA && !haveMname && tx.soa.Ns != "" && tx.s.cfg.SelfName != "" {
+    mnameGlue := &dns.CNAME{
+      Hdr: dns.RR_Header{
+        Name:   tx.soa.Ns, // the SOA's MNAME
+        Rrtype: dns.TypeCNAME,
+        Class:  dns.ClassINET,
+        Ttl:    tx.soa.Hdr.Ttl,
+      },
+      Target: dns.Fqdn(tx.s.cfg.SelfName),
+    }
+    tx.res.Extra = append(tx.res.Extra, mnameGlue)
+    tx.queueAdditional(dns.Fqdn(tx.s.cfg.SelfName))
+  }
+
+  return nil
+}
+
 func (tx *Tx) addNSEC() error {
   if !tx.useDNSSEC() || tx.suppressNSEC {
     return nil
@@ -531,23 +855,111 @@ func (tx *Tx) addNSEC() error {
   return nil
 }
 
+// addNSEC3RR builds the full RFC 5155 §7.2 denial-of-existence proof.
+//
+// The closest encloser is the deepest ancestor of qname (including qname
+// itself) that actually exists. If qname itself is the closest encloser,
+// we have a NODATA response and the matching NSEC3 -- with the real type
+// bitmap at that name -- is the whole proof; no wildcard could apply.
+// This includes a qtype==DS delegation with no DS, since the delegation's
+// NS is recorded at qname. Otherwise this is NXDOMAIN, and we additionally have to cover the "next closer name" -- the label of
+// qname's path immediately below the closest encloser -- and the
+// wildcard that would otherwise have synthesised an answer.
+//
+// Wildcard-match responses (where an answer was actually synthesised
+// from a wildcard) would only need the closest-encloser and next-closer
+// proofs and not the matching one; this tree doesn't synthesise wildcard
+// answers yet; so that case doesn't arise here.
 func (tx *Tx) addNSEC3RR() error {
-  // deny the name
-  err := tx.addNSEC3RRActual(tx.qname, tx.typesAtQname)
+  ce, ceTypes, err := tx.closestEncloser()
+  if err != nil {
+    return err
+  }
+
+  // (1) Prove the closest encloser exists, with its real type bitmap.
+  // This also proves no DS exists here, covering the qtype==DS
+  // delegation case: addAnswersDelegation only leaves addNSEC3RR
+  // reachable when it didn't find a DS to answer with, so the type
+  // bitmap below (lacking DS) is itself the "no DS here" proof.
+  err = tx.addNSEC3RRMatch(ce, ceTypes)
   if err != nil {
     return err
   }
 
-  // DEVEVER.BIT.
-  // deny DEVEVER.BIT. (DS)
-  // deny *.BIT.
+  if ce == tx.qname {
+    // NODATA: qname exists, just not with the queried type.
+    return nil
+  }
 
-  // deny the existence of a wildcard that could have served the name
+  // (2) Prove the next closer name doesn't exist.
+  err = tx.addNSEC3RRCover(tx.nextCloserName(ce))
+  if err != nil {
+    return err
+  }
 
-  return nil
+  // (3) Prove no wildcard under the closest encloser could have served
+  // the name either.
+  return tx.addNSEC3RRCover(absname("*." + ce))
+}
+
+// closestEncloser walks up the labels of qname, doing a blookup at each
+// level, to find the deepest ancestor (including qname itself) that has
+// records of its own. tx.typesAtQname is already populated with every
+// type found at qname during addAnswersAuthoritative, so if it's
+// non-empty qname is returned as its own closest encloser (a NODATA
+// response). addAnswersDelegation also records NS there for any qname at
+// or below a delegation point, so such a qname is returned as its own
+// closest encloser too. Otherwise we search upward towards the zone apex,
+// which always exists since tx.soa was found there.
+func (tx *Tx) closestEncloser() (string, map[uint16]struct{}, error) {
+  if len(tx.typesAtQname) > 0 {
+    return tx.qname, tx.typesAtQname, nil
+  }
+
+  apex := strings.TrimRight(tx.soa.Hdr.Name, ".")
+  n := strings.TrimRight(tx.qname, ".")
+
+  for len(n) > len(apex) {
+    nidx := strings.Index(n, ".")
+    if nidx < 0 {
+      break
+    }
+    n = n[nidx+1:]
+
+    rrs, err := tx.blookup(n)
+    if err == nil && len(rrs) > 0 {
+      tset := map[uint16]struct{}{}
+      for _, rr := range rrs {
+        tset[rr.Header().Rrtype] = struct{}{}
+      }
+      return absname(n), tset, nil
+    }
+  }
+
+  // Nothing between qname and the apex exists; the apex is the closest
+  // encloser. We know it has at least an SOA.
+  return tx.soa.Hdr.Name, map[uint16]struct{}{dns.TypeSOA: struct{}{}}, nil
+}
+
+// nextCloserName returns the immediate child label of closestEncloser on
+// the path down to qname -- the "next closer name" of RFC 5155 §7.2.1.
+func (tx *Tx) nextCloserName(closestEncloser string) string {
+  qn := strings.TrimRight(tx.qname, ".")
+  ce := strings.TrimRight(closestEncloser, ".")
+
+  if qn == ce {
+    return tx.qname
+  }
+
+  extra := strings.TrimSuffix(qn, "."+ce)
+  labels := strings.Split(extra, ".")
+
+  return absname(labels[len(labels)-1] + "." + ce)
 }
 
-func (tx *Tx) addNSEC3RRActual(name string, tset map[uint16]struct{}) error {
+// addNSEC3RRMatch adds an NSEC3 whose owner name hashes to exactly name,
+// carrying the type bitmap tset actually present there.
+func (tx *Tx) addNSEC3RRMatch(name string, tset map[uint16]struct{}) error {
   tbm := []uint16{}
   for t, _ := range tset {
     tbm = append(tbm, t)
@@ -555,11 +967,12 @@ func (tx *Tx) addNSEC3RRActual(name string, tset map[uint16]struct{}) error {
 
   sort.Sort(uint16Slice(tbm))
 
-  nsr1n  := dns.HashName(tx.qname, dns.SHA1, 1, "8F")
-  nsr1nn := stepName(nsr1n)
-  nsr1   := &dns.NSEC3 {
+  hash := dns.HashName(name, dns.SHA1, 1, "8F")
+  next := stepName(hash)
+
+  nsr := &dns.NSEC3 {
     Hdr: dns.RR_Header {
-      Name: absname(nsr1n + "." + tx.soa.Hdr.Name),
+      Name: absname(hash + "." + tx.soa.Hdr.Name),
       Rrtype: dns.TypeNSEC3,
       Class: dns.ClassINET,
       Ttl: 600,
@@ -569,15 +982,290 @@ func (tx *Tx) addNSEC3RRActual(name string, tset map[uint16]struct{}) error {
     Iterations: 1,
     SaltLength: 1,
     Salt: "8F",
-    HashLength: uint8(len(nsr1nn)),
-    NextDomain: nsr1nn,
+    HashLength: uint8(len(next)),
+    NextDomain: next,
     TypeBitMap: tbm,
   }
-  tx.res.Ns = append(tx.res.Ns, nsr1)
+  tx.res.Ns = append(tx.res.Ns, nsr)
+
+  return nil
+}
+
+// addNSEC3RRCover synthesizes an NSEC3 whose owner hash immediately
+// precedes name's hash and whose NextDomain immediately follows it,
+// proving that no record owned by name exists -- without claiming
+// anything about any other name in the zone.
+func (tx *Tx) addNSEC3RRCover(name string) error {
+  hash := dns.HashName(name, dns.SHA1, 1, "8F")
+  owner := predName(hash)
+  next := stepName(hash)
+
+  nsr := &dns.NSEC3 {
+    Hdr: dns.RR_Header {
+      Name: absname(owner + "." + tx.soa.Hdr.Name),
+      Rrtype: dns.TypeNSEC3,
+      Class: dns.ClassINET,
+      Ttl: 600,
+    },
+    Hash: dns.SHA1,
+    Flags: 0,
+    Iterations: 1,
+    SaltLength: 1,
+    Salt: "8F",
+    HashLength: uint8(len(owner)),
+    NextDomain: next,
+    TypeBitMap: []uint16{},
+  }
+  tx.res.Ns = append(tx.res.Ns, nsr)
+
+  return nil
+}
+
+// base32HexAlphabet is the lower-case form of the alphabet dns.HashName
+// encodes NSEC3 owner hashes with (HashName itself emits upper case). It
+// isn't ASCII-contiguous (there's a gap between '9' and 'a'), so predName
+// has to step through it by index rather than by decrementing bytes.
+const base32HexAlphabet = "0123456789abcdefghijklmnopqrstuv"
+
+// predName returns the lexical predecessor of a base32hex-encoded NSEC3
+// owner hash, in lower case, the mirror image of stepName's successor
+// computation. Paired with stepName it lets us synthesize an NSEC3 that
+// covers exactly one hashed name: owner = predName(hash), NextDomain =
+// stepName(hash).
+func predName(s string) string {
+  b := []byte(strings.ToLower(s))
+  for i := len(b) - 1; i >= 0; i-- {
+    idx := strings.IndexByte(base32HexAlphabet, b[i])
+    if idx == 0 {
+      b[i] = base32HexAlphabet[len(base32HexAlphabet)-1]
+      continue
+    }
+    b[i] = base32HexAlphabet[idx-1]
+    break
+  }
+  return string(b)
+}
+
+// sigCacheEntry is one entry in the RRSIG cache.
+type sigCacheEntry struct {
+  key string
+  rrsig *dns.RRSIG
+}
+
+// sigCache is a bounded LRU mapping a canonical RRset hash to a
+// previously computed RRSIG, so repeated queries for the same RRset
+// don't each pay the cost of an RSA signature. Server.handle runs
+// concurrently for simultaneous queries, so every access goes through mu.
+type sigCache struct {
+  mu sync.Mutex
+
+  maxEntries int
+  ll    *list.List
+  items map[string]*list.Element
+  hits, misses int64
+}
+
+func newSigCache(maxEntries int) *sigCache {
+  return &sigCache{
+    maxEntries: maxEntries,
+    ll:    list.New(),
+    items: map[string]*list.Element{},
+  }
+}
+
+func (c *sigCache) Get(key string) (*dns.RRSIG, bool) {
+  c.mu.Lock()
+  defer c.mu.Unlock()
+
+  if e, ok := c.items[key]; ok {
+    c.ll.MoveToFront(e)
+    c.hits++
+    return e.Value.(*sigCacheEntry).rrsig, true
+  }
+  c.misses++
+  return nil, false
+}
+
+func (c *sigCache) Add(key string, rrsig *dns.RRSIG) {
+  c.mu.Lock()
+  defer c.mu.Unlock()
+
+  if e, ok := c.items[key]; ok {
+    c.ll.MoveToFront(e)
+    e.Value.(*sigCacheEntry).rrsig = rrsig
+    return
+  }
+
+  e := c.ll.PushFront(&sigCacheEntry{key: key, rrsig: rrsig})
+  c.items[key] = e
+
+  if c.maxEntries > 0 && c.ll.Len() > c.maxEntries {
+    oldest := c.ll.Back()
+    if oldest != nil {
+      c.ll.Remove(oldest)
+      delete(c.items, oldest.Value.(*sigCacheEntry).key)
+    }
+  }
+}
+
+func (c *sigCache) Len() int {
+  c.mu.Lock()
+  defer c.mu.Unlock()
+
+  return c.ll.Len()
+}
+
+func (c *sigCache) HitRatio() float64 {
+  c.mu.Lock()
+  defer c.mu.Unlock()
+
+  total := c.hits + c.misses
+  if total == 0 {
+    return 0
+  }
+  return float64(c.hits) / float64(total)
+}
+
+// sigValidityWindow and sigInceptionBucket bound a cached RRSIG's
+// inception/expiration to fixed windows, so that two signing requests
+// for the same RRset within the same hour produce identical timestamps
+// and thus the same cache key, instead of differing by a few seconds of
+// wall-clock skew every time.
+const sigValidityWindow = 7 * 24 * time.Hour
+const sigInceptionBucket = time.Hour
+
+// signRRsetCached signs rrset as owned by k/privatek, reusing a
+// previously computed RRSIG for an identical canonical RRset where
+// possible instead of paying for another RSA signature.
+func (s *Server) signRRsetCached(rrset []dns.RR, k *dns.DNSKEY, privatek dns.PrivateKey) (*dns.RRSIG, error) {
+  now := time.Now().UTC()
+  inception := now.Truncate(sigInceptionBucket)
+  expiration := inception.Add(sigValidityWindow)
+
+  key := sigCacheKeyFor(rrset, k.KeyTag(), inception, expiration)
+
+  if rrsig, ok := s.sigCache.Get(key); ok {
+    return rrsig, nil
+  }
+
+  rrsig := &dns.RRSIG{
+    Hdr: dns.RR_Header{
+      Name:   rrset[0].Header().Name,
+      Rrtype: dns.TypeRRSIG,
+      Class:  rrset[0].Header().Class,
+      Ttl:    rrset[0].Header().Ttl,
+    },
+    Algorithm:  k.Algorithm,
+    KeyTag:     k.KeyTag(),
+    SignerName: k.Hdr.Name,
+    Inception:  uint32(inception.Unix()),
+    Expiration: uint32(expiration.Unix()),
+  }
+
+  signStart := time.Now()
+  err := rrsig.Sign(privatek, rrset)
+  metricSignDuration.Observe(time.Since(signStart).Seconds())
+  if err != nil {
+    return nil, err
+  }
+
+  s.sigCache.Add(key, rrsig)
+
+  return rrsig, nil
+}
+
+// sigCacheKeyFor computes a stable cache key for an RRset: the owner
+// name, class, type and TTL, the presentation text (rr.String()) of every
+// member in the order given, the signing key tag, and the
+// inception/expiration bucket. The text is not canonicalised, so RRsets
+// whose members differ only in order or letter case get different keys.
+func sigCacheKeyFor(rrset []dns.RR, keytag uint16, inception, expiration time.Time) string {
+  h := sha256.New()
+  hdr := rrset[0].Header()
+  fmt.Fprintf(h, "%s|%d|%d|%d|", hdr.Name, hdr.Class, hdr.Rrtype, hdr.Ttl)
+  for _, rr := range rrset {
+    fmt.Fprintf(h, "%s|", rr.String())
+  }
+  fmt.Fprintf(h, "%d|%d|%d", keytag, inception.Unix(), expiration.Unix())
+  return hex.EncodeToString(h.Sum(nil))
+}
+
+// signResponse signs every RRset in the Answer and Authority sections,
+// appending the resulting RRSIGs, using the signature cache to avoid
+// re-signing an RRset we've already produced a signature for.
+func (tx *Tx) signResponse() error {
+  if !tx.useDNSSEC() {
+    return nil
+  }
+
+  answerSigs, err := tx.signSection(tx.res.Answer)
+  if err != nil {
+    return err
+  }
+  tx.res.Answer = append(tx.res.Answer, answerSigs...)
+
+  nsSigs, err := tx.signSection(tx.res.Ns)
+  if err != nil {
+    return err
+  }
+  tx.res.Ns = append(tx.res.Ns, nsSigs...)
 
   return nil
 }
 
+// signSection signs every RRset found in rrs (grouped by owner name and
+// type) and returns the RRSIGs to append to that section. The DNSKEY
+// RRset is signed with the KSK; everything else with the ZSK, per usual
+// DNSSEC practice.
+func (tx *Tx) signSection(rrs []dns.RR) ([]dns.RR, error) {
+  var sigs []dns.RR
+  for _, rrset := range rrsetsIn(rrs) {
+    k, privatek := tx.s.zsk, tx.s.zskPrivate
+    if rrset[0].Header().Rrtype == dns.TypeDNSKEY {
+      k, privatek = tx.s.ksk, tx.s.kskPrivate
+    }
+
+    rrsig, err := tx.s.signRRsetCached(rrset, k, privatek)
+    if err != nil {
+      return nil, err
+    }
+    sigs = append(sigs, rrsig)
+  }
+  return sigs, nil
+}
+
+// rrsetsIn groups rrs by (owner name, type), skipping RRSIGs and OPT
+// records (neither of which get signed), preserving the order each
+// group first appeared in.
+func rrsetsIn(rrs []dns.RR) [][]dns.RR {
+  type rrsetKey struct {
+    name  string
+    rtype uint16
+  }
+
+  var order []rrsetKey
+  groups := map[rrsetKey][]dns.RR{}
+
+  for _, rr := range rrs {
+    t := rr.Header().Rrtype
+    if t == dns.TypeRRSIG || t == dns.TypeOPT {
+      continue
+    }
+
+    k := rrsetKey{rr.Header().Name, t}
+    if _, ok := groups[k]; !ok {
+      order = append(order, k)
+    }
+    groups[k] = append(groups[k], rr)
+  }
+
+  out := make([][]dns.RR, 0, len(order))
+  for _, k := range order {
+    out = append(out, groups[k])
+  }
+  return out
+}
+
 func (tx *Tx) addAdditional() error {
   for aname := range tx.additionalQueue {
     err := tx.addAdditionalItem(aname)
@@ -0,0 +1,96 @@
+package main
+
+import "testing"
+import "time"
+import "github.com/miekg/dns"
+
+func TestSigCacheKeyForIsStableWithinBucket(t *testing.T) {
+  a := &dns.A{
+    Hdr: dns.RR_Header{Name: "bit.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 3600},
+    A:   nil,
+  }
+  rrset := []dns.RR{a}
+
+  inception := time.Unix(1000000, 0)
+  expiration := inception.Add(sigValidityWindow)
+
+  k1 := sigCacheKeyFor(rrset, 1234, inception, expiration)
+  k2 := sigCacheKeyFor(rrset, 1234, inception, expiration)
+  if k1 != k2 {
+    t.Errorf("sigCacheKeyFor is not stable for identical input: %q != %q", k1, k2)
+  }
+
+  k3 := sigCacheKeyFor(rrset, 5678, inception, expiration)
+  if k1 == k3 {
+    t.Errorf("sigCacheKeyFor did not change when key tag changed")
+  }
+
+  k4 := sigCacheKeyFor(rrset, 1234, inception.Add(time.Second), expiration)
+  if k1 == k4 {
+    t.Errorf("sigCacheKeyFor did not change when inception changed")
+  }
+}
+
+func TestSigCacheAddAndGet(t *testing.T) {
+  c := newSigCache(2)
+
+  rrsig := &dns.RRSIG{Hdr: dns.RR_Header{Name: "bit."}}
+  c.Add("a", rrsig)
+
+  got, ok := c.Get("a")
+  if !ok || got != rrsig {
+    t.Fatalf("Get(%q) = %v, %v; want %v, true", "a", got, ok, rrsig)
+  }
+
+  if _, ok := c.Get("missing"); ok {
+    t.Fatalf("Get(%q) = _, true; want false", "missing")
+  }
+
+  // Adding past maxEntries should evict the least recently used entry.
+  c.Add("b", &dns.RRSIG{})
+  c.Add("c", &dns.RRSIG{}) // evicts "a": "b" was touched more recently
+
+  if _, ok := c.Get("a"); ok {
+    t.Fatalf("expected %q to have been evicted", "a")
+  }
+  if _, ok := c.Get("b"); !ok {
+    t.Fatalf("expected %q to still be cached", "b")
+  }
+}
+
+func TestPredName(t *testing.T) {
+  cases := []struct {
+    in, want string
+  }{
+    {"b", "a"},
+    {"a", "9"}, // the alphabet isn't ASCII-contiguous across the 9/a gap
+    {"0", "v"}, // single-char wrap
+    {"10", "0v"}, // borrow into the next digit
+    {"00", "vv"}, // borrow all the way through
+    {"v", "u"},
+  }
+
+  for _, c := range cases {
+    got := predName(c.in)
+    if got != c.want {
+      t.Errorf("predName(%q) = %q, want %q", c.in, got, c.want)
+    }
+  }
+}
+
+func TestNextCloserName(t *testing.T) {
+  tx := &Tx{qname: "www.example.bit."}
+  if got, want := tx.nextCloserName("example.bit."), "www.example.bit."; got != want {
+    t.Errorf("nextCloserName(%q) = %q, want %q", "example.bit.", got, want)
+  }
+
+  tx = &Tx{qname: "a.b.www.example.bit."}
+  if got, want := tx.nextCloserName("example.bit."), "www.example.bit."; got != want {
+    t.Errorf("nextCloserName(%q) = %q, want %q", "example.bit.", got, want)
+  }
+
+  tx = &Tx{qname: "example.bit."}
+  if got, want := tx.nextCloserName("example.bit."), "example.bit."; got != want {
+    t.Errorf("nextCloserName with qname == closest encloser = %q, want %q", got, want)
+  }
+}